@@ -0,0 +1,30 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// getCheckpointは指定されたシャードの最後に処理したシーケンス番号を取得する
+// まだチェックポイントが存在しない場合は空文字列を返す
+func getCheckpoint(db *sql.DB, shardID string) (string, error) {
+	var sequenceNumber string
+	err := db.QueryRow("SELECT sequence_number FROM shard_checkpoints WHERE shard_id = ?", shardID).Scan(&sequenceNumber)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return sequenceNumber, nil
+}
+
+// saveCheckpointは処理済みのシーケンス番号をshard_checkpointsテーブルに永続化する
+func saveCheckpoint(db *sql.DB, shardID, sequenceNumber string) {
+	query := `INSERT INTO shard_checkpoints (shard_id, sequence_number, updated_at)
+		VALUES (?, ?, NOW())
+		ON DUPLICATE KEY UPDATE sequence_number = VALUES(sequence_number), updated_at = NOW()`
+	if _, err := db.Exec(query, shardID, sequenceNumber); err != nil {
+		log.Printf("Failed to save checkpoint for shard %s: %v", shardID, err)
+	}
+}
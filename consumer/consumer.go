@@ -2,26 +2,39 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"log"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 
-	"atone-hands-on/consumer/events"
 	"atone-hands-on/producer"
+	"atone-hands-on/producer/bus"
+	"atone-hands-on/producer/events"
+	"atone-hands-on/producer/saga"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
 )
 
 const (
 	streamName = "atone-events-stream"
 	region     = "ap-northeast-1"
 	dbSource   = "root:password@tcp(127.0.0.1:3306)/atone_hands_on?parseTime=true"
+	redisAddr  = "localhost:6379"
+
+	shardPollInterval   = 5 * time.Second  // ListShardsが失敗した時の再試行間隔
+	reshardPollInterval = 30 * time.Second // リシャーディング検知のためのListShards再実行間隔
+	defaultBatchSize    = 100
 )
 
 func main() {
@@ -41,72 +54,243 @@ func main() {
 	}
 	defer db.Close()
 
-	// UIサーバーのWebSocketに接続
-	ws, _, err := websocket.DefaultDialer.Dial("ws://localhost:8080/ws", nil)
-	if err != nil {
-		log.Fatalf("failed to connect to WebSocket server: %v", err)
+	// `consumer rebuild` サブコマンドは通常のシャード購読ループには入らず、
+	// 保存済みのeventsテーブルを順に再生してプロジェクションを再構築する
+	if len(os.Args) > 1 && os.Args[1] == "rebuild" {
+		dryRun := false
+		for _, arg := range os.Args[2:] {
+			if arg == "--dry-run" {
+				dryRun = true
+			}
+		}
+		if err := runRebuild(ctx, db, kinesisClient, dryRun); err != nil {
+			log.Fatalf("rebuild failed: %v", err)
+		}
+		return
+	}
+
+	// プロジェクション変更の通知バス（Redis Pub/Sub）を初期化
+	redisClient := redis.NewClient(&redis.Options{Addr: redisAddr})
+	defer redisClient.Close()
+	updateBus := bus.NewRedisBus(redisClient)
+
+	// 督促サーガ: 支払期日を過ぎた未払い請求を定期的に検知し、督促ラダー(YAML)に従って
+	// BillOverdueEvent→DunningNoticeIssuedEvent→CollectionEscalatedEventを段階的に発行する
+	if ladder, err := saga.LoadLadder(defaultLadderPath); err != nil {
+		log.Printf("failed to load dunning escalation ladder, dunning saga disabled: %v", err)
+	} else {
+		go runDunningSaga(ctx, db, kinesisClient, ladder)
+	}
+
+	workerID := uuid.New().String()
+	batchSize := envInt("CONSUMER_BATCH_SIZE", defaultBatchSize)
+	log.Printf("Starting consumer worker %s (batch size: %d)", workerID, batchSize)
+
+	owned := newShardSet()
+
+	// 定期的にListShardsを呼び出し、新規シャード・子シャードの出現を検知して
+	// まだ誰も処理していないシャードにコンシューマゴルーチンを割り当てる
+	// （親シャードがクローズされ再シャーディングが起きると、次回の呼び出しで子シャードが現れる）
+	for {
+		shards, err := listAllShards(ctx, kinesisClient)
+		if err != nil {
+			log.Printf("failed to list shards: %v", err)
+			time.Sleep(shardPollInterval)
+			continue
+		}
+
+		for _, shard := range shards {
+			shardID := aws.ToString(shard.ShardId)
+			if owned.has(shardID) {
+				continue
+			}
+			owned.add(shardID)
+			go func(s types.Shard) {
+				defer owned.remove(aws.ToString(s.ShardId))
+				consumeShard(ctx, db, kinesisClient, updateBus, s, workerID, batchSize)
+			}(shard)
+		}
+
+		time.Sleep(reshardPollInterval)
+	}
+}
+
+// shardSetは現在このワーカーが処理中のシャードIDを追跡する
+type shardSet struct {
+	mu   sync.Mutex
+	ids  map[string]bool
+}
+
+func newShardSet() *shardSet {
+	return &shardSet{ids: make(map[string]bool)}
+}
+
+func (s *shardSet) has(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ids[id]
+}
+
+func (s *shardSet) add(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids[id] = true
+}
+
+func (s *shardSet) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ids, id)
+}
+
+// listAllShardsはページネーションを辿ってストリームの全シャード（クローズ済みの親も含む）を取得する
+func listAllShards(ctx context.Context, client *kinesis.Client) ([]types.Shard, error) {
+	var shards []types.Shard
+	var nextToken *string
+
+	for {
+		input := &kinesis.ListShardsInput{}
+		if nextToken != nil {
+			input.NextToken = nextToken
+		} else {
+			input.StreamName = aws.String(streamName)
+		}
+
+		output, err := client.ListShards(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, output.Shards...)
+
+		if output.NextToken == nil {
+			break
+		}
+		nextToken = output.NextToken
 	}
-	defer ws.Close()
 
-	// ストリームのシャードIDを取得
-	shards, err := getShards(ctx, kinesisClient)
+	return shards, nil
+}
+
+// consumeShardは1つのシャードについてリースを確保しながらレコードを取得・処理し続ける
+func consumeShard(ctx context.Context, db *sql.DB, kinesisClient *kinesis.Client, updateBus bus.Publisher, shard types.Shard, workerID string, batchSize int) {
+	shardID := aws.ToString(shard.ShardId)
+
+	acquired, err := acquireLease(db, shardID, workerID)
 	if err != nil {
-		log.Fatalf("failed to get shards: %v", err)
+		log.Printf("failed to acquire lease for shard %s: %v", shardID, err)
+		return
 	}
-	if len(shards) == 0 {
-		log.Fatal("no shards found")
+	if !acquired {
+		log.Printf("shard %s is owned by another worker, skipping", shardID)
+		return
 	}
-	shardID := aws.ToString(shards[0].ShardId)
+	defer releaseLease(db, shardID, workerID)
 
-	// イテレーターを作成
-	iteratorOutput, err := kinesisClient.GetShardIterator(ctx, &kinesis.GetShardIteratorInput{
-		ShardId:           aws.String(shardID),
-		ShardIteratorType: types.ShardIteratorTypeLatest, //ここを TrimHorizon から Latest に変更
-		StreamName:        aws.String(streamName),
-	})
+	heartbeatStop := make(chan struct{})
+	defer close(heartbeatStop)
+	go func() {
+		ticker := time.NewTicker(leaseRenewEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := renewLease(db, shardID, workerID); err != nil {
+					log.Printf("failed to renew lease for shard %s: %v", shardID, err)
+				}
+			case <-heartbeatStop:
+				return
+			}
+		}
+	}()
+
+	shardIterator, err := startingIterator(ctx, db, kinesisClient, shardID)
 	if err != nil {
-		log.Fatalf("failed to get shard iterator: %v", err)
+		log.Printf("failed to get shard iterator for shard %s: %v", shardID, err)
+		return
 	}
-	shardIterator := iteratorOutput.ShardIterator
 
-	log.Println("Listening for events...")
+	log.Printf("Listening for events on shard %s...", shardID)
 
-	// レコードの取得ループ
+	backoff := time.Second
 	for {
 		recordsOutput, err := kinesisClient.GetRecords(ctx, &kinesis.GetRecordsInput{
 			ShardIterator: shardIterator,
+			Limit:         aws.Int32(int32(batchSize)),
 		})
 		if err != nil {
-			log.Fatalf("failed to get records: %v", err)
+			if isProvisionedThroughputExceeded(err) {
+				log.Printf("shard %s throughput exceeded, backing off for %s", shardID, backoff)
+				time.Sleep(backoff)
+				if backoff < 30*time.Second {
+					backoff *= 2
+				}
+				continue
+			}
+			log.Printf("failed to get records for shard %s: %v", shardID, err)
+			return
 		}
+		backoff = time.Second
 
-		if len(recordsOutput.Records) > 0 {
-			for _, record := range recordsOutput.Records {
-				processEvent(ctx, db, kinesisClient, record, ws)
-			}
+		for _, record := range recordsOutput.Records {
+			processEvent(ctx, db, kinesisClient, updateBus, record)
+			saveCheckpoint(db, shardID, aws.ToString(record.SequenceNumber))
 		}
 
-		shardIterator = recordsOutput.NextShardIterator
-		if shardIterator == nil {
-			log.Println("Shard iterator is nil. Exiting.")
-			break
+		if recordsOutput.NextShardIterator == nil {
+			log.Printf("shard %s is closed, exiting consumer goroutine", shardID)
+			return
 		}
+		shardIterator = recordsOutput.NextShardIterator
 
-		time.Sleep(1 * time.Second)
+		if len(recordsOutput.Records) == 0 {
+			time.Sleep(1 * time.Second)
+		}
 	}
 }
 
-// getShardsはストリームのシャード情報を取得するヘルパー関数
-func getShards(ctx context.Context, client *kinesis.Client) ([]types.Shard, error) {
-	output, err := client.DescribeStream(ctx, &kinesis.DescribeStreamInput{StreamName: aws.String(streamName)})
+// startingIteratorは永続化済みのチェックポイントがあればそこから、なければストリーム先頭(TrimHorizon)から
+// イテレーターを作成する
+func startingIterator(ctx context.Context, db *sql.DB, client *kinesis.Client, shardID string) (*string, error) {
+	sequenceNumber, err := getCheckpoint(db, shardID)
 	if err != nil {
 		return nil, err
 	}
-	return output.StreamDescription.Shards, nil
+
+	input := &kinesis.GetShardIteratorInput{
+		ShardId:    aws.String(shardID),
+		StreamName: aws.String(streamName),
+	}
+	if sequenceNumber != "" {
+		input.ShardIteratorType = types.ShardIteratorTypeAfterSequenceNumber
+		input.StartingSequenceNumber = aws.String(sequenceNumber)
+	} else {
+		input.ShardIteratorType = types.ShardIteratorTypeTrimHorizon
+	}
+
+	output, err := client.GetShardIterator(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return output.ShardIterator, nil
+}
+
+// isProvisionedThroughputExceededはKinesisのスロットリングエラーかどうかを判定する
+func isProvisionedThroughputExceeded(err error) bool {
+	var throughputErr *types.ProvisionedThroughputExceededException
+	return errors.As(err, &throughputErr)
+}
+
+func envInt(key string, fallback int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return fallback
 }
 
 // processEventは受信したイベントを処理する
-func processEvent(ctx context.Context, db *sql.DB, kinesisClient *kinesis.Client, record types.Record, ws *websocket.Conn) {
+func processEvent(ctx context.Context, db *sql.DB, kinesisClient *kinesis.Client, updateBus bus.Publisher, record types.Record) {
 	log.Printf("Received event: %s\n", record.Data)
 
 	var genericEvent map[string]interface{}
@@ -115,46 +299,82 @@ func processEvent(ctx context.Context, db *sql.DB, kinesisClient *kinesis.Client
 		return
 	}
 
+	eventType, ok := genericEvent["event_type"].(string)
+	if !ok || eventType == "" {
+		log.Printf("Received record with missing or malformed event_type, skipping: %s", record.Data)
+		return
+	}
+
+	eventUUID, _ := genericEvent["event_uuid"].(string)
+	if eventUUID != "" {
+		alreadyProcessed, err := eventAlreadyProcessed(db, eventUUID)
+		if err != nil {
+			log.Printf("Failed to check event idempotency: %v", err)
+			return
+		}
+		if alreadyProcessed {
+			log.Printf("Skipping already-processed event %s", eventUUID)
+			return
+		}
+	}
+
 	// イベントをeventsテーブルに保存
-	saveEventToDB(db, record.Data, genericEvent["event_type"].(string))
+	saveEventToDB(db, eventUUID, record.Data, eventType)
+
+	projectEvent(ctx, db, kinesisClient, updateBus, eventType, record.Data, false)
+}
 
-	// イベントタイプに応じて処理を分岐
-	switch genericEvent["event_type"] {
+// projectEventはイベントタイプに応じてプロジェクションテーブルを更新し、必要であれば
+// 派生イベントをKinesisへ発行する。projectionOnlyがtrueの場合（`consumer rebuild`による
+// リプレイ時）は、派生イベントの再発行とバスへの通知を行わず、投影の再構築のみを行う
+func projectEvent(ctx context.Context, db *sql.DB, kinesisClient *kinesis.Client, updateBus bus.Publisher, eventType string, data []byte, projectionOnly bool) {
+	switch eventType {
 	case "PurchaseCompletedEvent":
 		var purchaseEvent events.PurchaseCompletedEvent
-		if err := json.Unmarshal(record.Data, &purchaseEvent); err != nil {
+		if err := json.Unmarshal(data, &purchaseEvent); err != nil {
 			log.Printf("Failed to unmarshal purchase event: %v", err)
 			return
 		}
 
+		if projectionOnly {
+			// リプレイ時は派生イベントを再発行しない（投影のみ行う）
+			break
+		}
+
 		// 支払約束イベントを生成
 		promiseID := uuid.New().String()
 		promiseEvent := events.PaymentPromiseCreatedEvent{
-			EventType:   "PaymentPromiseCreatedEvent",
-			PromiseID:   promiseID,
-			OrderID:     purchaseEvent.OrderID,
-			UserID:      purchaseEvent.UserID,
-			DueDate:     time.Now().Add(30 * 24 * time.Hour).Format("2006-01-02"), // 30日後の期日を設定
-			PaymentMode: "月まとめ払い", // ハンズオンでは固定
+			EventType:     "PaymentPromiseCreatedEvent",
+			EventUUID:     uuid.New().String(),
+			SchemaVersion: events.CurrentSchemaVersion,
+			PromiseID:     promiseID,
+			OrderID:       purchaseEvent.OrderID,
+			UserID:        purchaseEvent.UserID,
+			DueDate:       time.Now().Add(30 * 24 * time.Hour).Format("2006-01-02"), // 30日後の期日を設定
+			PaymentMode:   "月まとめ払い", // ハンズオンでは固定
 		}
 
 		// 新しいイベントをKinesisに発行
-		if err := producer.EmitEvent(ctx, kinesisClient, promiseEvent); err != nil {
+		if err := producer.EmitEvent(ctx, kinesisClient, promiseEvent, promiseEvent.UserID); err != nil {
 			log.Printf("Failed to emit payment promise event: %v", err)
 		}
 	case "PaymentPromiseCreatedEvent":
 		var promiseEvent events.PaymentPromiseCreatedEvent
-		if err := json.Unmarshal(record.Data, &promiseEvent); err != nil {
+		if err := json.Unmarshal(data, &promiseEvent); err != nil {
 			log.Printf("Failed to unmarshal promise event: %v", err)
 			return
 		}
 
 		savePromiseToDB(db, promiseEvent)
-	    log.Printf("Payment promise projection created: %+v", promiseEvent)
+		log.Printf("Payment promise projection created: %+v", promiseEvent)
+
+		if !projectionOnly {
+			publishUpdate(ctx, updateBus, bus.UpdatePromiseCreated, promiseEvent.UserID, promiseEvent)
+		}
 
 	case "MemberBillCreatedEvent":
 		var billEvent events.MemberBillCreatedEvent
-		if err := json.Unmarshal(record.Data, &billEvent); err != nil {
+		if err := json.Unmarshal(data, &billEvent); err != nil {
 			log.Printf("Failed to unmarshal bill event: %v", err)
 			return
 		}
@@ -163,9 +383,13 @@ func processEvent(ctx context.Context, db *sql.DB, kinesisClient *kinesis.Client
 		saveMemberBillToDB(db, billEvent)
 		log.Printf("Member bill projection created: %+v", billEvent)
 
+		if !projectionOnly {
+			publishUpdate(ctx, updateBus, bus.UpdateBillCreated, billEvent.UserID, billEvent)
+		}
+
 	case "PaymentCompletedEvent":
 		var paymentEvent events.PaymentCompletedEvent
-		if err := json.Unmarshal(record.Data, &paymentEvent); err != nil {
+		if err := json.Unmarshal(data, &paymentEvent); err != nil {
 			log.Printf("Failed to unmarshal payment event: %v", err)
 			return
 		}
@@ -174,17 +398,130 @@ func processEvent(ctx context.Context, db *sql.DB, kinesisClient *kinesis.Client
 		updateMemberBillStatus(db, paymentEvent)
 		log.Printf("Member bill status updated to paid: %+v", paymentEvent)
 
-		// UIサーバーに更新通知を送信
-		if err := ws.WriteMessage(websocket.TextMessage, []byte("update")); err != nil {
-			log.Printf("Failed to write to WebSocket: %v", err)
+		// すぐ払いモードの請求であればインボイスのステータスも pending → paid に遷移させる
+		updateInvoiceStatusPaid(db, paymentEvent.BillID)
+
+		if projectionOnly {
+			break
+		}
+
+		publishUpdate(ctx, updateBus, bus.UpdatePaymentReceived, paymentEvent.UserID, paymentEvent)
+
+	case "MonthlyBillSealedEvent":
+		var sealedEvent events.MonthlyBillSealedEvent
+		if err := json.Unmarshal(data, &sealedEvent); err != nil {
+			log.Printf("Failed to unmarshal monthly bill sealed event: %v", err)
+			return
+		}
+
+		monthlyBillID, created, err := saveMonthlyBillToDB(db, sealedEvent)
+		if err != nil {
+			log.Printf("Failed to save monthly bill projection: %v", err)
+			return
+		}
+		if !created {
+			// UNIQUE(user_id, period)に抵触した場合は既に締め済み。再配信や
+			// スケジューラの再実行による重複締めを防ぐため、ここで処理を打ち切る
+			log.Printf("Monthly bill for user %s period %s already sealed, skipping", sealedEvent.UserID, sealedEvent.Period)
+			return
+		}
+		markPromisesSealed(db, sealedEvent.PromiseIDs)
+		log.Printf("Monthly bill projection created: %+v", sealedEvent)
+
+		if projectionOnly {
+			break
+		}
+
+		// 集約請求を1件発行する。個々のpayment_promiseではなく束ねたmonthly_billsの
+		// 行IDに紐づく請求であることが分かるよう、MonthlyBillIDに入れる（PromiseIDは
+		// すぐ払いモード専用のフィールドなので空のままにする）
+		billEvent := events.MemberBillCreatedEvent{
+			EventType:     "MemberBillCreatedEvent",
+			EventUUID:     uuid.New().String(),
+			SchemaVersion: events.CurrentSchemaVersion,
+			BillID:        uuid.New().String(),
+			MonthlyBillID: monthlyBillID,
+			UserID:        sealedEvent.UserID,
+			Amount:        sealedEvent.TotalAmount,
+			IssuedDate:    time.Now().Format("2006-01-02"),
+			DueDate:       time.Now().Add(30 * 24 * time.Hour).Format("2006-01-02"), // 30日後の期日を設定
+		}
+		if err := producer.EmitEvent(ctx, kinesisClient, billEvent, billEvent.UserID); err != nil {
+			log.Printf("Failed to emit member bill created event for monthly bill %s: %v", monthlyBillID, err)
+		}
+
+	case "BillOverdueEvent":
+		var overdueEvent events.BillOverdueEvent
+		if err := json.Unmarshal(data, &overdueEvent); err != nil {
+			log.Printf("Failed to unmarshal bill overdue event: %v", err)
+			return
+		}
+
+		updateDunningStage(db, overdueEvent.BillID, "overdue")
+		log.Printf("Dunning stage projection updated to overdue: %+v", overdueEvent)
+
+		if !projectionOnly {
+			publishUpdate(ctx, updateBus, bus.UpdateDunningStageChanged, overdueEvent.UserID, overdueEvent)
+		}
+
+	case "DunningNoticeIssuedEvent":
+		var noticeEvent events.DunningNoticeIssuedEvent
+		if err := json.Unmarshal(data, &noticeEvent); err != nil {
+			log.Printf("Failed to unmarshal dunning notice issued event: %v", err)
+			return
+		}
+
+		updateDunningStage(db, noticeEvent.BillID, "dunning_notice")
+		log.Printf("Dunning stage projection updated to dunning_notice: %+v", noticeEvent)
+
+		if !projectionOnly {
+			publishUpdate(ctx, updateBus, bus.UpdateDunningStageChanged, noticeEvent.UserID, noticeEvent)
+		}
+
+	case "CollectionEscalatedEvent":
+		var escalatedEvent events.CollectionEscalatedEvent
+		if err := json.Unmarshal(data, &escalatedEvent); err != nil {
+			log.Printf("Failed to unmarshal collection escalated event: %v", err)
+			return
+		}
+
+		updateDunningStage(db, escalatedEvent.BillID, "escalated")
+		log.Printf("Dunning stage projection updated to escalated: %+v", escalatedEvent)
+
+		if !projectionOnly {
+			publishUpdate(ctx, updateBus, bus.UpdateDunningStageChanged, escalatedEvent.UserID, escalatedEvent)
 		}
 	}
 }
 
-// saveEventToDBはイベントをeventsテーブルに保存する
-func saveEventToDB(db *sql.DB, data []byte, eventType string) {
-	query := "INSERT INTO events (id, event_type, event_data) VALUES (?, ?, ?)"
-	_, err := db.Exec(query, uuid.New().String(), eventType, string(data))
+// publishUpdateはプロジェクションの変更をバスに発行する。発行エラーはプロジェクション自体の
+// 成否には影響しないため、ログに残すのみで処理は継続する
+func publishUpdate(ctx context.Context, updateBus bus.Publisher, msgType int, userID string, data interface{}) {
+	msg := bus.Message{UserID: userID, Type: msgType, Data: data}
+	if err := updateBus.Publish(ctx, msg); err != nil {
+		log.Printf("Failed to publish update to bus: %v", err)
+	}
+}
+
+// eventAlreadyProcessedはevent_uuidを手掛かりに、このイベントが既にevents テーブルへ
+// 保存済みかどうかを調べる。Kinesisはat-least-once配信のため、再配信された同一イベントで
+// プロジェクションを二重に更新しないようにする
+func eventAlreadyProcessed(db *sql.DB, eventUUID string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM events WHERE event_uuid = ?", eventUUID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// saveEventToDBはイベントをeventsテーブルに保存する。seqはAUTO_INCREMENTのため
+// 書き込み順がそのままグローバルな発生順となり、rebuildはこのseq昇順で再生する。
+// content_hashはイベント本文のSHA-256で、改ざん検知やリプレイ前後の内容比較に使う
+func saveEventToDB(db *sql.DB, eventUUID string, data []byte, eventType string) {
+	hash := sha256.Sum256(data)
+	query := "INSERT INTO events (id, event_uuid, event_type, event_data, content_hash) VALUES (?, ?, ?, ?, ?)"
+	_, err := db.Exec(query, uuid.New().String(), eventUUID, eventType, string(data), hex.EncodeToString(hash[:]))
 	if err != nil {
 		log.Printf("Failed to save event to DB: %v", err)
 	}
@@ -201,10 +538,12 @@ func savePromiseToDB(db *sql.DB, promise events.PaymentPromiseCreatedEvent) {
 	}
 }
 
-// saveMemberBillToDBは会員請求をmember_billsテーブルに保存する
+// saveMemberBillToDBは会員請求をmember_billsテーブルに保存する。
+// promise_idとmonthly_bill_idは支払モードに応じて片方だけが埋まる（すぐ払い: promise_id、
+// 月まとめ払い: monthly_bill_id）ため、空文字列の方はNULLとして保存する
 func saveMemberBillToDB(db *sql.DB, bill events.MemberBillCreatedEvent) {
-	query := "INSERT INTO member_bills (id, promise_id, user_id, amount, status, issued_date) VALUES (?, ?, ?, ?, ?, ?)"
-	_, err := db.Exec(query, bill.BillID, bill.PromiseID, bill.UserID, bill.Amount, "unpaid", bill.IssuedDate)
+	query := "INSERT INTO member_bills (id, promise_id, monthly_bill_id, user_id, amount, status, issued_date, due_date) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err := db.Exec(query, bill.BillID, nullableString(bill.PromiseID), nullableString(bill.MonthlyBillID), bill.UserID, bill.Amount, "unpaid", bill.IssuedDate, bill.DueDate)
 	if err != nil {
 		log.Printf("Failed to save member bill to DB: %v", err)
 	}
@@ -217,4 +556,19 @@ func updateMemberBillStatus(db *sql.DB, payment events.PaymentCompletedEvent) {
 	if err != nil {
 		log.Printf("Failed to update member bill status: %v", err)
 	}
-}
\ No newline at end of file
+}
+
+// updateInvoiceStatusPaidは、支払い完了イベントを受けてインボイスのステータスを
+// pending から paid へ遷移させる。すぐ払いモード以外の請求にはインボイスが存在しないため、
+// 該当行がなくてもエラーとしては扱わない
+func updateInvoiceStatusPaid(db *sql.DB, billID string) {
+	query := "UPDATE invoices SET status = 'paid' WHERE bill_id = ? AND status = 'pending'"
+	if _, err := db.Exec(query, billID); err != nil {
+		log.Printf("Failed to update invoice status for bill %s: %v", billID, err)
+	}
+}
+
+// nullableStringは空文字列をSQL上のNULLとして扱うためのヘルパー
+func nullableString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
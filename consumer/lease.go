@@ -0,0 +1,50 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+const (
+	leaseDuration   = 30 * time.Second
+	leaseRenewEvery = 10 * time.Second
+)
+
+// acquireLeaseは指定されたシャードの所有権を取得しようと試みる
+// 既に他のワーカーが有効なリースを保持している場合はfalseを返す
+func acquireLease(db *sql.DB, shardID, workerID string) (bool, error) {
+	res, err := db.Exec(`INSERT INTO shard_leases (shard_id, owner_id, expires_at)
+		VALUES (?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))
+		ON DUPLICATE KEY UPDATE
+			owner_id = IF(expires_at < NOW(), VALUES(owner_id), owner_id),
+			expires_at = IF(expires_at < NOW(), VALUES(expires_at), expires_at)`,
+		shardID, workerID, int(leaseDuration.Seconds()))
+	if err != nil {
+		return false, err
+	}
+
+	var owner string
+	if err := db.QueryRow("SELECT owner_id FROM shard_leases WHERE shard_id = ?", shardID).Scan(&owner); err != nil {
+		return false, err
+	}
+
+	rowsAffected, _ := res.RowsAffected()
+	log.Printf("Lease attempt for shard %s by %s (rows affected: %d, current owner: %s)", shardID, workerID, rowsAffected, owner)
+
+	return owner == workerID, nil
+}
+
+// renewLeaseは保持中のリースの有効期限を延長するハートビートを送信する
+func renewLease(db *sql.DB, shardID, workerID string) error {
+	_, err := db.Exec(`UPDATE shard_leases SET expires_at = DATE_ADD(NOW(), INTERVAL ? SECOND)
+		WHERE shard_id = ? AND owner_id = ?`, int(leaseDuration.Seconds()), shardID, workerID)
+	return err
+}
+
+// releaseLeaseはワーカー終了時にリースを手放す
+func releaseLease(db *sql.DB, shardID, workerID string) {
+	if _, err := db.Exec("DELETE FROM shard_leases WHERE shard_id = ? AND owner_id = ?", shardID, workerID); err != nil {
+		log.Printf("Failed to release lease for shard %s: %v", shardID, err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+
+	"atone-hands-on/producer/events"
+
+	"github.com/google/uuid"
+)
+
+// saveMonthlyBillToDBはMonthlyBillSealedEventをmonthly_billsテーブルへ投影する。
+// (user_id, period)のUNIQUE制約に抵触した場合は既に締め済みであるとみなし、
+// createdにfalseを返して呼び出し元に二重締めを起こさせない
+func saveMonthlyBillToDB(db *sql.DB, sealedEvent events.MonthlyBillSealedEvent) (id string, created bool, err error) {
+	promiseIDsJSON, err := json.Marshal(sealedEvent.PromiseIDs)
+	if err != nil {
+		return "", false, err
+	}
+
+	id = uuid.New().String()
+	query := `INSERT INTO monthly_bills (id, user_id, period, promise_ids, total_amount)
+		VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE id = id`
+	result, err := db.Exec(query, id, sealedEvent.UserID, sealedEvent.Period, string(promiseIDsJSON), sealedEvent.TotalAmount)
+	if err != nil {
+		return "", false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return "", false, err
+	}
+	if rowsAffected == 0 {
+		// ON DUPLICATE KEY UPDATEが何も変更しなかった = 既存行がそのまま
+		return "", false, nil
+	}
+
+	return id, true, nil
+}
+
+// markPromisesSealedは締められた支払約束にsealed_atを記録し、以後のスケジューラ実行で
+// 再び集計対象にならないようにする
+func markPromisesSealed(db *sql.DB, promiseIDs []string) {
+	query := "UPDATE payment_promises SET sealed_at = NOW() WHERE id = ? AND sealed_at IS NULL"
+	for _, promiseID := range promiseIDs {
+		if _, err := db.Exec(query, promiseID); err != nil {
+			log.Printf("Failed to mark promise %s as sealed: %v", promiseID, err)
+		}
+	}
+}
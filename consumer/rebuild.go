@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+)
+
+// runRebuildはpayment_promises、member_bills、monthly_billsを空にした上で、eventsテーブルを
+// seq昇順に読み直し、processEventと同じ分岐を「投影のみ」モードで再適用してプロジェクションを
+// 再構築する。書き込みモデル（events）を唯一の真実の情報源として扱うイベントソーシングの
+// 標準的なリビルド手順であり、開発中に投影の形を変えてもイベント自体は失わずに済む
+func runRebuild(ctx context.Context, db *sql.DB, kinesisClient *kinesis.Client, dryRun bool) error {
+	count, err := countEvents(db)
+	if err != nil {
+		return err
+	}
+	log.Printf("Rebuilding projections from %d stored events (dry-run: %v)", count, dryRun)
+
+	if dryRun {
+		log.Println("Dry-run: projections would be truncated and replayed, no changes made")
+		return nil
+	}
+
+	if err := truncateProjections(db); err != nil {
+		return err
+	}
+
+	rows, err := db.Query("SELECT event_type, event_data FROM events ORDER BY seq ASC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	replayed := 0
+	for rows.Next() {
+		var eventType, eventData string
+		if err := rows.Scan(&eventType, &eventData); err != nil {
+			return err
+		}
+
+		projectEvent(ctx, db, kinesisClient, nil, eventType, []byte(eventData), true)
+		replayed++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	log.Printf("Rebuild complete: replayed %d events", replayed)
+	return nil
+}
+
+func countEvents(db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM events").Scan(&count)
+	return count, err
+}
+
+// truncateProjectionsは書き込みモデル(events)には触れず、読み取りモデルのみを消去する。
+// monthly_billsも忘れずに含める必要がある。ここを空にしないと、リプレイされる
+// MonthlyBillSealedEventがsaveMonthlyBillToDBの(user_id, period)UNIQUE制約に
+// 既存行として引っかかり、created=falseで早期リターンしてmarkPromisesSealedが
+// 呼ばれなくなる。その結果、リプレイで作り直されたpayment_promisesはsealed_atが
+// 永久にNULLのままとなり、スケジューラが同じ期間を再び締めようとしてしまう
+func truncateProjections(db *sql.DB) error {
+	if _, err := db.Exec("TRUNCATE TABLE payment_promises"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("TRUNCATE TABLE member_bills"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("TRUNCATE TABLE monthly_bills"); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"atone-hands-on/producer"
+	"atone-hands-on/producer/events"
+	"atone-hands-on/producer/saga"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/google/uuid"
+)
+
+const (
+	sagaScanInterval  = time.Minute
+	defaultLadderPath = "producer/saga/escalation_ladder.yaml"
+)
+
+// runDunningSagaは、支払期日を過ぎても未払いのままの請求を定期的に検知し、督促ラダーに
+// 従ってBillOverdueEvent→DunningNoticeIssuedEvent→CollectionEscalatedEventを段階的に
+// 発行する長寿命のゴルーチン。進行状況はsaga_instancesテーブルに永続化されるため、
+// プロセスの再起動をまたいでも二重発行や段階の巻き戻りは起きない
+func runDunningSaga(ctx context.Context, db *sql.DB, kinesisClient *kinesis.Client, ladder saga.Ladder) {
+	if len(ladder.Steps) == 0 {
+		log.Printf("dunning saga ladder has no steps, saga loop will not run")
+		return
+	}
+
+	ticker := time.NewTicker(sagaScanInterval)
+	defer ticker.Stop()
+	for {
+		startOverdueSagas(db, ladder)
+		advanceDueSagas(ctx, db, kinesisClient, ladder)
+		<-ticker.C
+	}
+}
+
+// startOverdueSagasは、支払期日を過ぎたのにまだサーガが開始されていないunpaid請求を見つけ、
+// saga_instancesに初期状態（ラダーの1段階目待ち）の行を作る
+func startOverdueSagas(db *sql.DB, ladder saga.Ladder) {
+	rows, err := db.Query(
+		`SELECT mb.id, mb.due_date FROM member_bills mb
+		LEFT JOIN saga_instances si ON si.bill_id = mb.id
+		WHERE mb.status = 'unpaid' AND mb.due_date < NOW() AND si.bill_id IS NULL`)
+	if err != nil {
+		log.Printf("failed to scan for newly overdue bills: %v", err)
+		return
+	}
+
+	type overdueBill struct {
+		billID  string
+		dueDate time.Time
+	}
+	var bills []overdueBill
+	for rows.Next() {
+		var b overdueBill
+		if err := rows.Scan(&b.billID, &b.dueDate); err != nil {
+			log.Printf("failed to scan overdue bill row: %v", err)
+			continue
+		}
+		bills = append(bills, b)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("failed to iterate overdue bill rows: %v", err)
+	}
+	rows.Close()
+
+	for _, b := range bills {
+		nextActionAt := b.dueDate.AddDate(0, 0, ladder.Steps[0].AfterDays)
+		if err := createSagaInstance(db, b.billID, nextActionAt); err != nil {
+			log.Printf("failed to create saga instance for bill %s: %v", b.billID, err)
+		}
+	}
+}
+
+// advanceDueSagasは、次のアクション予定時刻を過ぎた進行中のサーガを1段階進め、
+// ラダーに定義されたイベントを発行する
+func advanceDueSagas(ctx context.Context, db *sql.DB, kinesisClient *kinesis.Client, ladder saga.Ladder) {
+	instances, err := dueSagaInstances(db)
+	if err != nil {
+		log.Printf("failed to load due saga instances: %v", err)
+		return
+	}
+
+	for _, inst := range instances {
+		if inst.attempts >= len(ladder.Steps) {
+			continue // 既に最終段階まで到達済み
+		}
+		step := ladder.Steps[inst.attempts]
+
+		if err := emitLadderEvent(ctx, kinesisClient, step, inst); err != nil {
+			log.Printf("failed to emit %s for bill %s: %v", step.Event, inst.billID, err)
+			continue
+		}
+
+		attempts := inst.attempts + 1
+		var nextActionAt *time.Time
+		if attempts < len(ladder.Steps) {
+			t := inst.dueDate.AddDate(0, 0, ladder.Steps[attempts].AfterDays)
+			nextActionAt = &t
+		}
+		if err := advanceSagaInstance(db, inst.billID, step.State, attempts, nextActionAt); err != nil {
+			log.Printf("failed to advance saga instance for bill %s: %v", inst.billID, err)
+		}
+	}
+}
+
+// emitLadderEventはラダーの1段階に対応するドメインイベントを組み立ててKinesisに発行する
+func emitLadderEvent(ctx context.Context, kinesisClient *kinesis.Client, step saga.LadderStep, inst sagaInstance) error {
+	dueDate := inst.dueDate.Format("2006-01-02")
+
+	switch step.Event {
+	case "BillOverdueEvent":
+		return producer.EmitEvent(ctx, kinesisClient, events.BillOverdueEvent{
+			EventType:     "BillOverdueEvent",
+			EventUUID:     uuid.New().String(),
+			SchemaVersion: events.CurrentSchemaVersion,
+			BillID:        inst.billID,
+			UserID:        inst.userID,
+			DueDate:       dueDate,
+		}, inst.userID)
+	case "DunningNoticeIssuedEvent":
+		return producer.EmitEvent(ctx, kinesisClient, events.DunningNoticeIssuedEvent{
+			EventType:     "DunningNoticeIssuedEvent",
+			EventUUID:     uuid.New().String(),
+			SchemaVersion: events.CurrentSchemaVersion,
+			BillID:        inst.billID,
+			UserID:        inst.userID,
+			DueDate:       dueDate,
+		}, inst.userID)
+	case "CollectionEscalatedEvent":
+		return producer.EmitEvent(ctx, kinesisClient, events.CollectionEscalatedEvent{
+			EventType:     "CollectionEscalatedEvent",
+			EventUUID:     uuid.New().String(),
+			SchemaVersion: events.CurrentSchemaVersion,
+			BillID:        inst.billID,
+			UserID:        inst.userID,
+			DueDate:       dueDate,
+		}, inst.userID)
+	default:
+		return fmt.Errorf("unknown ladder event type: %s", step.Event)
+	}
+}
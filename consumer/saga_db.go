@@ -0,0 +1,72 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// sagaInstanceはsaga_instancesテーブルの1行と、督促ラダーを進めるために必要な
+// member_bills側の情報（user_id, due_date）を合わせ持つ
+type sagaInstance struct {
+	billID   string
+	userID   string
+	state    string
+	dueDate  time.Time
+	attempts int
+}
+
+// createSagaInstanceは新たに支払期日を過ぎたunpaid請求についてサーガの初期状態行を作る。
+// 既に行が存在する場合（2回のスキャンが競合した場合など）は何もしない
+func createSagaInstance(db *sql.DB, billID string, nextActionAt time.Time) error {
+	query := `INSERT INTO saga_instances (bill_id, state, next_action_at, attempts)
+		VALUES (?, '', ?, 0)
+		ON DUPLICATE KEY UPDATE bill_id = bill_id`
+	_, err := db.Exec(query, billID, nextActionAt)
+	return err
+}
+
+// dueSagaInstancesは次のアクション予定時刻(next_action_at)を過ぎた、進行中（未払いのまま）の
+// サーガインスタンスを取得する
+func dueSagaInstances(db *sql.DB) ([]sagaInstance, error) {
+	rows, err := db.Query(
+		`SELECT si.bill_id, mb.user_id, si.state, mb.due_date, si.attempts
+		FROM saga_instances si
+		JOIN member_bills mb ON mb.id = si.bill_id
+		WHERE mb.status = 'unpaid' AND si.next_action_at IS NOT NULL AND si.next_action_at <= NOW()`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var instances []sagaInstance
+	for rows.Next() {
+		var inst sagaInstance
+		if err := rows.Scan(&inst.billID, &inst.userID, &inst.state, &inst.dueDate, &inst.attempts); err != nil {
+			return nil, err
+		}
+		instances = append(instances, inst)
+	}
+	return instances, rows.Err()
+}
+
+// advanceSagaInstanceはラダーを1段階進めた後の状態を永続化する。nextActionAtがnilの場合は
+// 最終段階に達したことを意味し、以後このサーガはdueSagaInstancesの対象から外れる
+func advanceSagaInstance(db *sql.DB, billID, state string, attempts int, nextActionAt *time.Time) error {
+	var nt sql.NullTime
+	if nextActionAt != nil {
+		nt = sql.NullTime{Time: *nextActionAt, Valid: true}
+	}
+	query := "UPDATE saga_instances SET state = ?, attempts = ?, next_action_at = ? WHERE bill_id = ?"
+	_, err := db.Exec(query, state, attempts, nt, billID)
+	return err
+}
+
+// updateDunningStageは、現在の督促段階をmember_billsに投影する。これにより
+// /user/:userId/status は別テーブルを引くことなく現在の段階を表示できる
+func updateDunningStage(db *sql.DB, billID, stage string) {
+	query := "UPDATE member_bills SET dunning_stage = ? WHERE id = ?"
+	if _, err := db.Exec(query, stage, billID); err != nil {
+		log.Printf("Failed to update dunning stage for bill %s: %v", billID, err)
+	}
+}
@@ -2,17 +2,23 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis"
 	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
 	"atone-hands-on/producer"
+	"atone-hands-on/producer/bus"
 	"atone-hands-on/producer/commands"
 	"atone-hands-on/producer/events"
+	"atone-hands-on/producer/payments"
 	"github.com/google/uuid"
 	_ "github.com/go-sql-driver/mysql"
 	"database/sql"
@@ -27,15 +33,10 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-// WebSocket接続を管理するクライアント構造体
-type Client struct {
-	conn *websocket.Conn
-	send chan []byte
-}
-
 const (
-	region   = "ap-northeast-1"
-	dbSource = "root:password@tcp(127.0.0.1:3306)/atone_hands_on?parseTime=true&charset=utf8mb4"
+	region    = "ap-northeast-1"
+	dbSource  = "root:password@tcp(127.0.0.1:3306)/atone_hands_on?parseTime=true&charset=utf8mb4"
+	redisAddr = "localhost:6379"
 )
 
 func main() {
@@ -54,24 +55,21 @@ func main() {
 	}
 	defer db.Close()
 
-	// クライアントを管理するためのハブ
-	clients := make(map[*Client]bool)
-	broadcast := make(chan []byte)
+	// すぐ払いモードのインボイス発行プロバイダ（ハンズオンではモック実装を使う）
+	paymentProvider := payments.Provider(payments.NewMockLNProvider())
 
-	// バックグラウンドでブロードキャストを処理
-	go func() {
-		for {
-			msg := <-broadcast
-			for client := range clients {
-				if err := client.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-					log.Printf("WebSocket write error: %v", err)
-					client.conn.Close()
-					delete(clients, client)
-				}
-			}
-		}
-	}()
+	// 空文字列のままでは空キーのHMACが常に検証を通ってしまい、署名検証が無意味になるため、
+	// 設定されていない場合は起動自体を拒否する
+	invoiceWebhookSecret := os.Getenv("INVOICE_WEBHOOK_SECRET")
+	if invoiceWebhookSecret == "" {
+		log.Fatal("INVOICE_WEBHOOK_SECRET must be set")
+	}
 
+	// プロジェクション変更の通知バス（Redis Pub/Sub）。コンシューマー側の更新をここで受け取り、
+	// 対象ユーザーのWebSocket接続にだけファンアウトする
+	redisClient := redis.NewClient(&redis.Options{Addr: redisAddr})
+	defer redisClient.Close()
+	updateBus := bus.NewRedisBus(redisClient)
 
 	r := gin.Default()
 	r.LoadHTMLGlob("templates/*")
@@ -86,14 +84,16 @@ func main() {
 
 		// 購入完了イベントを生成
 		purchaseEvent := events.PurchaseCompletedEvent{
-			EventType: "PurchaseCompletedEvent",
-			OrderID:   "order-" + cmd.UserID, // シンプルなID生成
-			UserID:    cmd.UserID,
-			Amount:    cmd.Amount,
+			EventType:     "PurchaseCompletedEvent",
+			EventUUID:     uuid.New().String(),
+			SchemaVersion: events.CurrentSchemaVersion,
+			OrderID:       "order-" + cmd.UserID, // シンプルなID生成
+			UserID:        cmd.UserID,
+			Amount:        cmd.Amount,
 		}
 
 		// Kinesisにイベントを発行
-		err := producer.EmitEvent(ctx, kinesisClient, purchaseEvent)
+		err := producer.EmitEvent(ctx, kinesisClient, purchaseEvent, purchaseEvent.UserID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to emit event"})
 			return
@@ -110,46 +110,99 @@ func main() {
 			return
 		}
 
+		// すぐ払いモードなので、請求イベントを発行する前に決済プロバイダへインボイスを
+		// 発行させ、invoicesテーブルに記録しておく。先にMemberBillCreatedEventを
+		// 発行してしまうと、この後のインボイス発行が失敗した場合に「請求は存在するが
+		// 支払う手段がない」という回復不能な状態がイベントストアに残ってしまう
+		billID := uuid.New().String()
+		invoice, err := paymentProvider.CreateInvoice(ctx, billID, cmd.Amount)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invoice"})
+			return
+		}
+		if err := saveInvoiceToDB(db, invoice); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save invoice"})
+			return
+		}
+
 		billEvent := events.MemberBillCreatedEvent{
-			EventType:  "MemberBillCreatedEvent",
-			BillID:     uuid.New().String(),
-			PromiseID:  cmd.PromiseID,
-			UserID:     cmd.UserID,
-			Amount:     cmd.Amount,
-			IssuedDate: time.Now().Format("2006-01-02"),
+			EventType:     "MemberBillCreatedEvent",
+			EventUUID:     uuid.New().String(),
+			SchemaVersion: events.CurrentSchemaVersion,
+			BillID:        billID,
+			PromiseID:     cmd.PromiseID,
+			UserID:        cmd.UserID,
+			Amount:        cmd.Amount,
+			IssuedDate:    time.Now().Format("2006-01-02"),
+			DueDate:       time.Now().Add(30 * 24 * time.Hour).Format("2006-01-02"), // 30日後の期日を設定
 		}
 
-		err := producer.EmitEvent(ctx, kinesisClient, billEvent)
-		if err != nil {
+		if err := producer.EmitEvent(ctx, kinesisClient, billEvent, billEvent.UserID); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to emit event"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "Member bill created event emitted for immediate payment"})
+		c.JSON(http.StatusOK, gin.H{
+			"message":    "Member bill created event emitted for immediate payment",
+			"bill_id":    billEvent.BillID,
+			"invoice_id": invoice.InvoiceID,
+		})
 	})
 
-	// 支払い完了Webhookを受け付けるエンドポイント
-	r.POST("/webhook/payment-completed", func(c *gin.Context) {
+	// すぐ払いモードの請求に紐づくインボイス（支払いペイロード）を取得するエンドポイント
+	r.GET("/bill/:id/invoice", func(c *gin.Context) {
+		billID := c.Param("id")
+
+		invoice, err := getInvoice(db, billID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get invoice"})
+			return
+		}
+
+		c.JSON(http.StatusOK, invoice)
+	})
+
+	// インボイス支払い完了Webhookを受け付けるエンドポイント
+	// 決済プロバイダからのコールバックはINVOICE_WEBHOOK_SECRET（共有シークレット）によるHMAC署名で検証する
+	r.POST("/webhook/invoice-paid", func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			return
+		}
+
+		signature := c.GetHeader("X-Signature")
+		if !payments.VerifyWebhookSignature(invoiceWebhookSecret, body, signature) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid webhook signature"})
+			return
+		}
+
 		var webhookPayload struct {
-			BillID string `json:"bill_id"`
-			UserID string `json:"user_id"`
-			Amount int    `json:"amount"`
+			BillID    string `json:"bill_id"`
+			InvoiceID string `json:"invoice_id"`
+			UserID    string `json:"user_id"`
+			Amount    int    `json:"amount"`
 		}
-		if err := c.ShouldBindJSON(&webhookPayload); err != nil {
+		if err := json.Unmarshal(body, &webhookPayload); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
 		paymentEvent := events.PaymentCompletedEvent{
-			EventType: "PaymentCompletedEvent",
-			BillID:    webhookPayload.BillID,
-			UserID:    webhookPayload.UserID,
-			Amount:    webhookPayload.Amount,
-			PaidDate:  time.Now().Format("2006-01-02"),
+			EventType:     "PaymentCompletedEvent",
+			EventUUID:     uuid.New().String(),
+			SchemaVersion: events.CurrentSchemaVersion,
+			BillID:        webhookPayload.BillID,
+			UserID:        webhookPayload.UserID,
+			Amount:        webhookPayload.Amount,
+			PaidDate:      time.Now().Format("2006-01-02"),
 		}
 
-		err := producer.EmitEvent(ctx, kinesisClient, paymentEvent)
-		if err != nil {
+		if err := producer.EmitEvent(ctx, kinesisClient, paymentEvent, paymentEvent.UserID); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to emit event"})
 			return
 		}
@@ -183,24 +236,53 @@ func main() {
 	})
 
 	// WebSocketエンドポイント
+	// 接続ごとにバスを購読し、自分宛て（userId一致）の通知だけをブラウザへ転送する
+	// 本来はgorilla/sessionsのRedisバックエンドセッションからuserIdを引くべきだが、
+	// ハンズオンの範囲ではクエリパラメータで代用する
 	r.GET("/ws", func(c *gin.Context) {
+		userId := c.Query("userId")
+		if userId == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "userId query parameter is required"})
+			return
+		}
+
 		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
 			log.Printf("WebSocket upgrade error: %v", err)
 			return
 		}
+		defer conn.Close()
+
+		subCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
 
-		client := &Client{conn: conn, send: make(chan []byte, 256)}
-		clients[client] = true
-		defer func() {
-			conn.Close()
-			delete(clients, client)
+		updates, err := updateBus.Subscribe(subCtx)
+		if err != nil {
+			log.Printf("Failed to subscribe to update bus: %v", err)
+			return
+		}
+
+		go func() {
+			for msg := range updates {
+				if msg.UserID != userId {
+					continue
+				}
+				payload, err := json.Marshal(msg)
+				if err != nil {
+					log.Printf("Failed to marshal update message: %v", err)
+					continue
+				}
+				if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+					log.Printf("WebSocket write error: %v", err)
+					cancel()
+					return
+				}
+			}
 		}()
 
-		// クライアントからのメッセージを処理（ここでは何もしない）
+		// クライアントからのメッセージを処理（ここでは何もしない。切断検知のみ）
 		for {
-			_, _, err := conn.ReadMessage()
-			if err != nil {
+			if _, _, err := conn.ReadMessage(); err != nil {
 				break
 			}
 		}
@@ -238,7 +320,7 @@ func getPaymentPromises(db *sql.DB, userId string) ([]gin.H, error) {
 
 // getMemberBillsは指定されたユーザーの請求状況を取得する
 func getMemberBills(db *sql.DB, userId string) ([]gin.H, error) {
-	rows, err := db.Query("SELECT id, amount, status, issued_date, paid_date FROM member_bills WHERE user_id = ?", userId)
+	rows, err := db.Query("SELECT id, amount, status, issued_date, paid_date, dunning_stage FROM member_bills WHERE user_id = ?", userId)
 	if err != nil {
 		return nil, err
 	}
@@ -249,22 +331,69 @@ func getMemberBills(db *sql.DB, userId string) ([]gin.H, error) {
 		var id, status string
 		var amount int
 		var issuedDate time.Time
-		var paidDate sql.NullTime // paid_dateはNULLの可能性があるためsql.NullTimeを使用
-		if err := rows.Scan(&id, &amount, &status, &issuedDate, &paidDate); err != nil {
+		var paidDate sql.NullTime       // paid_dateはNULLの可能性があるためsql.NullTimeを使用
+		var dunningStage sql.NullString // 支払期日を過ぎていなければNULL
+		if err := rows.Scan(&id, &amount, &status, &issuedDate, &paidDate, &dunningStage); err != nil {
 			return nil, err
 		}
 
 		bill := gin.H{
-			"billId":      id,
-			"amount":      amount,
-			"status":      status,
-			"issuedDate":  issuedDate.Format("2006-01-02"),
-			"paidDate":    nil,
+			"billId":       id,
+			"amount":       amount,
+			"status":       status,
+			"issuedDate":   issuedDate.Format("2006-01-02"),
+			"paidDate":     nil,
+			"payNowUrl":    nil,
+			"dunningStage": nil,
 		}
 		if paidDate.Valid {
 			bill["paidDate"] = paidDate.Time.Format("2006-01-02")
 		}
+		if dunningStage.Valid {
+			bill["dunningStage"] = dunningStage.String
+		}
+		// 未払いのすぐ払い請求には、支払い中のインボイスがあればpay-nowリンクを載せる
+		if status == "unpaid" {
+			if invoice, err := getInvoice(db, id); err == nil && invoice["status"] == "pending" {
+				bill["payNowUrl"] = invoice["payloadUrl"]
+			}
+		}
 		bills = append(bills, bill)
 	}
 	return bills, nil
+}
+
+// saveInvoiceToDBはすぐ払いモードのインボイスをinvoicesテーブルに保存する（初期状態はpending）
+func saveInvoiceToDB(db *sql.DB, invoice payments.Invoice) error {
+	query := "INSERT INTO invoices (bill_id, invoice_id, payload_url, status, expires_at) VALUES (?, ?, ?, ?, ?)"
+	_, err := db.Exec(query, invoice.BillID, invoice.InvoiceID, invoice.PayloadURL, "pending", invoice.ExpiresAt)
+	return err
+}
+
+// getInvoiceは指定された請求IDに紐づくインボイスを取得する
+// pendingのまま有効期限を過ぎているインボイスはこの時点でexpiredに遷移させる
+func getInvoice(db *sql.DB, billID string) (gin.H, error) {
+	var invoiceID, payloadURL, status string
+	var expiresAt time.Time
+	err := db.QueryRow("SELECT invoice_id, payload_url, status, expires_at FROM invoices WHERE bill_id = ?", billID).
+		Scan(&invoiceID, &payloadURL, &status, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if status == "pending" && time.Now().After(expiresAt) {
+		if _, err := db.Exec("UPDATE invoices SET status = 'expired' WHERE bill_id = ? AND status = 'pending'", billID); err != nil {
+			log.Printf("Failed to expire invoice for bill %s: %v", billID, err)
+		} else {
+			status = "expired"
+		}
+	}
+
+	return gin.H{
+		"billId":     billID,
+		"invoiceId":  invoiceID,
+		"payloadUrl": payloadURL,
+		"status":     status,
+		"expiresAt":  expiresAt.Format(time.RFC3339),
+	}, nil
 }
\ No newline at end of file
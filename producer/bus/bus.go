@@ -0,0 +1,28 @@
+package bus
+
+import "context"
+
+// 通知メッセージの種別
+const (
+	UpdatePromiseCreated = iota
+	UpdateBillCreated
+	UpdatePaymentReceived
+	UpdateDunningStageChanged
+)
+
+// Messageはプロジェクションの変更をUIへ伝える際の型付き通知
+type Message struct {
+	UserID string      `json:"user_id"`
+	Type   int         `json:"type"`
+	Data   interface{} `json:"data"`
+}
+
+// Publisherはプロジェクションの変更をバスに発行する
+type Publisher interface {
+	Publish(ctx context.Context, msg Message) error
+}
+
+// Subscriberはバスから通知を受け取るチャネルを開く
+type Subscriber interface {
+	Subscribe(ctx context.Context) (<-chan Message, error)
+}
@@ -0,0 +1,69 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const channelName = "atone-updates"
+
+// RedisBusはRedisのPub/SubをバックエンドとするPublisher/Subscriberの実装
+// これにより、プロデューサーとコンシューマーが同一プロセス内のマップを共有する必要がなくなり、
+// どちらも複数インスタンスに水平スケールできるようになる
+type RedisBus struct {
+	client *redis.Client
+}
+
+// NewRedisBusはRedisBusを生成する
+func NewRedisBus(client *redis.Client) *RedisBus {
+	return &RedisBus{client: client}
+}
+
+// Publishはメッセージをatone-updatesチャネルにJSONとして発行する
+func (b *RedisBus) Publish(ctx context.Context, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(ctx, channelName, data).Err()
+}
+
+// Subscribeはatone-updatesチャネルを購読し、受信したメッセージをチャネル経由で流す
+// ctxがキャンセルされるとRedis購読を解除してチャネルをクローズする
+func (b *RedisBus) Subscribe(ctx context.Context) (<-chan Message, error) {
+	pubsub := b.client.Subscribe(ctx, channelName)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return nil, err
+	}
+
+	out := make(chan Message)
+	go func() {
+		defer close(out)
+		defer pubsub.Close()
+
+		redisCh := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case redisMsg, ok := <-redisCh:
+				if !ok {
+					return
+				}
+				var msg Message
+				if err := json.Unmarshal([]byte(redisMsg.Payload), &msg); err != nil {
+					continue
+				}
+				select {
+				case out <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
@@ -1,38 +1,98 @@
 package events
 
+// CurrentSchemaVersionは、このハンズオンで現在発行されているイベントのスキーマバージョン
+// イベントの構造を変える際はこの値を上げ、投影側(consumer)で後方互換の分岐を書く
+const CurrentSchemaVersion = 1
+
 // PurchaseCompletedEventは、商品購入が完了した事実を表す
 type PurchaseCompletedEvent struct {
-	EventType string `json:"event_type"`
-	OrderID   string `json:"order_id"`
-	UserID    string `json:"user_id"`
-	Amount    int    `json:"amount"`
+	EventType     string `json:"event_type"`
+	EventUUID     string `json:"event_uuid"` // 冪等性チェックに使う一意なイベントID
+	SchemaVersion int    `json:"schema_version"`
+	OrderID       string `json:"order_id"`
+	UserID        string `json:"user_id"`
+	Amount        int    `json:"amount"`
 }
 
 // PaymentPromiseCreatedEventは、支払約束が作成された事実を表す
 type PaymentPromiseCreatedEvent struct {
-	EventType    string `json:"event_type"`
-	PromiseID    string `json:"promise_id"`
-	OrderID      string `json:"order_id"`
-	UserID       string `json:"user_id"`
-	DueDate      string `json:"due_date"`
-	PaymentMode  string `json:"payment_mode"` // "すぐ払い" or "月まとめ払い"
+	EventType     string `json:"event_type"`
+	EventUUID     string `json:"event_uuid"`
+	SchemaVersion int    `json:"schema_version"`
+	PromiseID     string `json:"promise_id"`
+	OrderID       string `json:"order_id"`
+	UserID        string `json:"user_id"`
+	DueDate       string `json:"due_date"`
+	PaymentMode   string `json:"payment_mode"` // "すぐ払い" or "月まとめ払い"
 }
 
 // MemberBillCreatedEventは、会員への請求が行われた事実を表す
 type MemberBillCreatedEvent struct {
-	EventType  string `json:"event_type"`
-	BillID     string `json:"bill_id"`
-	PromiseID  string `json:"promise_id"`
-	UserID     string `json:"user_id"`
-	Amount     int    `json:"amount"`
-	IssuedDate string `json:"issued_date"`
+	EventType     string `json:"event_type"`
+	EventUUID     string `json:"event_uuid"`
+	SchemaVersion int    `json:"schema_version"`
+	BillID        string `json:"bill_id"`
+	PromiseID     string `json:"promise_id,omitempty"`      // すぐ払いモード: 紐づくpayment_promises.id
+	MonthlyBillID string `json:"monthly_bill_id,omitempty"` // 月まとめ払いモード: 紐づくmonthly_bills.id
+	UserID        string `json:"user_id"`
+	Amount        int    `json:"amount"`
+	IssuedDate    string `json:"issued_date"`
+	DueDate       string `json:"due_date"`
 }
 
 // PaymentCompletedEventは、会員による支払いが完了した事実を表す
 type PaymentCompletedEvent struct {
-	EventType string `json:"event_type"`
-	BillID    string `json:"bill_id"`
-	UserID    string `json:"user_id"`
-	Amount    int    `json:"amount"`
-	PaidDate  string `json:"paid_date"`
+	EventType     string `json:"event_type"`
+	EventUUID     string `json:"event_uuid"`
+	SchemaVersion int    `json:"schema_version"`
+	BillID        string `json:"bill_id"`
+	UserID        string `json:"user_id"`
+	Amount        int    `json:"amount"`
+	PaidDate      string `json:"paid_date"`
+}
+
+// MonthlyBillSealedEventは、月まとめ払いの支払約束が締め日に1ユーザー分まとめて
+// 締められた事実を表す。この後にconsumer側で集約請求(MemberBillCreatedEvent)が
+// 1件派生する
+type MonthlyBillSealedEvent struct {
+	EventType     string   `json:"event_type"`
+	EventUUID     string   `json:"event_uuid"`
+	SchemaVersion int      `json:"schema_version"`
+	UserID        string   `json:"user_id"`
+	Period        string   `json:"period"` // 締め対象の年月 "YYYY-MM"
+	PromiseIDs    []string `json:"promise_ids"`
+	TotalAmount   int      `json:"total_amount"`
+}
+
+// BillOverdueEventは、会員請求の支払期日を過ぎても未払いのままである事実を表す。
+// dunningサーガの起点となるイベント
+type BillOverdueEvent struct {
+	EventType     string `json:"event_type"`
+	EventUUID     string `json:"event_uuid"`
+	SchemaVersion int    `json:"schema_version"`
+	BillID        string `json:"bill_id"`
+	UserID        string `json:"user_id"`
+	DueDate       string `json:"due_date"`
+}
+
+// DunningNoticeIssuedEventは、督促状（dunning notice）が発行された事実を表す。
+// BillOverdueEventの後、督促ラダーで定められた猶予期間を過ぎても未払いの場合に発生する
+type DunningNoticeIssuedEvent struct {
+	EventType     string `json:"event_type"`
+	EventUUID     string `json:"event_uuid"`
+	SchemaVersion int    `json:"schema_version"`
+	BillID        string `json:"bill_id"`
+	UserID        string `json:"user_id"`
+	DueDate       string `json:"due_date"`
+}
+
+// CollectionEscalatedEventは、督促サーガが最終段階（債権回収へのエスカレーション）に
+// 達した事実を表す
+type CollectionEscalatedEvent struct {
+	EventType     string `json:"event_type"`
+	EventUUID     string `json:"event_uuid"`
+	SchemaVersion int    `json:"schema_version"`
+	BillID        string `json:"bill_id"`
+	UserID        string `json:"user_id"`
+	DueDate       string `json:"due_date"`
 }
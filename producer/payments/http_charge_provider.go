@@ -0,0 +1,24 @@
+package payments
+
+import (
+	"context"
+	"errors"
+)
+
+// HTTPChargeProviderは、実際の決済ゲートウェイのHTTPチャージAPIを呼び出す本番想定のプロバイダ
+// ハンズオンでは実クレデンシャルを持たないため、呼び出し部分は未実装のスタブとなっている
+type HTTPChargeProvider struct {
+	BaseURL string
+	APIKey  string
+}
+
+// NewHTTPChargeProviderはHTTPChargeProviderを生成する
+func NewHTTPChargeProvider(baseURL, apiKey string) *HTTPChargeProvider {
+	return &HTTPChargeProvider{BaseURL: baseURL, APIKey: apiKey}
+}
+
+// CreateInvoiceは本来BaseURLの課金APIを叩いてインボイスを発行するが、
+// このハンズオンでは未実装のためエラーを返すのみとしている
+func (p *HTTPChargeProvider) CreateInvoice(ctx context.Context, billID string, amount int) (Invoice, error) {
+	return Invoice{}, errors.New("HTTPChargeProvider is not implemented yet")
+}
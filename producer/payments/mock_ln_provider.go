@@ -0,0 +1,32 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const mockInvoiceExpiry = 15 * time.Minute
+
+// MockLNProviderはLightning Network風のインボイスをその場で生成するだけのモック実装
+// ハンズオンでは実際の決済ゲートウェイと接続しないため、支払いはPOST /webhook/invoice-paid
+// を手動で叩くことで模擬する
+type MockLNProvider struct{}
+
+// NewMockLNProviderはMockLNProviderを生成する
+func NewMockLNProvider() *MockLNProvider {
+	return &MockLNProvider{}
+}
+
+// CreateInvoiceはランダムなインボイスIDを発行し、疑似的な支払いペイロードURLを返す
+func (p *MockLNProvider) CreateInvoice(ctx context.Context, billID string, amount int) (Invoice, error) {
+	invoiceID := uuid.New().String()
+	return Invoice{
+		BillID:     billID,
+		InvoiceID:  invoiceID,
+		PayloadURL: fmt.Sprintf("lnmock://invoice/%s?amount=%d", invoiceID, amount),
+		ExpiresAt:  time.Now().Add(mockInvoiceExpiry),
+	}, nil
+}
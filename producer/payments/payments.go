@@ -0,0 +1,21 @@
+package payments
+
+import (
+	"context"
+	"time"
+)
+
+// Invoiceは決済プロバイダが発行した支払いリクエスト（インボイス）を表す
+type Invoice struct {
+	BillID     string
+	InvoiceID  string
+	PayloadURL string
+	ExpiresAt  time.Time
+}
+
+// Providerは、すぐ払いモードの会員請求に対してインボイスを発行する決済プロバイダの抽象
+// 具体的な決済手段（Lightning風のモック、将来の実際のHTTP課金APIなど）はこのインターフェースの
+// 実装として差し替え可能にする
+type Provider interface {
+	CreateInvoice(ctx context.Context, billID string, amount int) (Invoice, error)
+}
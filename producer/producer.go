@@ -11,8 +11,11 @@ import (
 
 const streamName = "atone-events-stream"
 
-// EmitEventはKinesisストリームにイベントを発行する
-func EmitEvent(ctx context.Context, client *kinesis.Client, event interface{}) error {
+// EmitEventはKinesisストリームにイベントを発行する。partitionKeyにはuserIdなど
+// イベントの当事者を表すIDを渡す。全イベントが同じパーティションキーだとストリーム上の
+// 1シャードにしか書き込まれず、複数シャードを前提としたコンシューマー側の並列処理が
+// 意味をなさなくなるため、呼び出し側でイベントごとに異なるキーを指定する
+func EmitEvent(ctx context.Context, client *kinesis.Client, event interface{}, partitionKey string) error {
 	data, err := json.Marshal(event)
 	if err != nil {
 		return err
@@ -21,7 +24,7 @@ func EmitEvent(ctx context.Context, client *kinesis.Client, event interface{}) e
 	_, err = client.PutRecord(ctx, &kinesis.PutRecordInput{
 		Data:         data,
 		StreamName:   aws.String(streamName),
-		PartitionKey: aws.String("partition-key-1"),
+		PartitionKey: aws.String(partitionKey),
 	})
 
 	if err != nil {
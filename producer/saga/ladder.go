@@ -0,0 +1,36 @@
+package saga
+
+import (
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LadderStepは督促ラダーの1段階を表す。AfterDaysは支払期日(due_date)からの経過日数で、
+// その日数に達した時点でstateに遷移しeventという名前のイベントを発行する
+type LadderStep struct {
+	State     string `yaml:"state"`
+	AfterDays int    `yaml:"after_days"`
+	Event     string `yaml:"event"`
+}
+
+// Ladderは督促の段階を期日からの経過日数順に並べたもの。コードを変更せずに
+// 「何日後にリマインド/督促状/エスカレーションを行うか」を運用側で調整できるよう、
+// YAMLファイルとして外部化している
+type Ladder struct {
+	Steps []LadderStep `yaml:"steps"`
+}
+
+// LoadLadderは指定されたYAMLファイルから督促ラダーを読み込む
+func LoadLadder(path string) (Ladder, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Ladder{}, err
+	}
+
+	var ladder Ladder
+	if err := yaml.Unmarshal(data, &ladder); err != nil {
+		return Ladder{}, err
+	}
+	return ladder, nil
+}
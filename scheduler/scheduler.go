@@ -0,0 +1,160 @@
+package main
+
+// schedulerは月まとめ払いの締め処理を行うバッチジョブ。常駐プロセスではなく、
+// 月末23:59 JSTにcron/k8s CronJob等の外部スケジューラから1回だけ起動される想定。
+// 対象月の payment_promises (payment_mode = 月まとめ払い, 未締め) をユーザーごとに
+// まとめ、MonthlyBillSealedEventを1ユーザー1件発行する。consumer側がこれを受けて
+// monthly_billsテーブルへの投影と、集約請求(MemberBillCreatedEvent)の発行を行う。
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"log"
+	"time"
+
+	"atone-hands-on/producer"
+	"atone-hands-on/producer/events"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+)
+
+const (
+	region   = "ap-northeast-1"
+	dbSource = "root:password@tcp(127.0.0.1:3306)/atone_hands_on?parseTime=true&charset=utf8mb4"
+
+	jst = "Asia/Tokyo"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "締め対象を表示するだけで、イベントは発行しない")
+	period := flag.String("period", "", "締め対象の年月をYYYY-MM形式で指定する（省略時は先月分）")
+	flag.Parse()
+
+	ctx := context.TODO()
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+	kinesisClient := kinesis.NewFromConfig(cfg)
+
+	db, err := sql.Open("mysql", dbSource)
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	targetPeriod := *period
+	if targetPeriod == "" {
+		targetPeriod, err = previousPeriod()
+		if err != nil {
+			log.Fatalf("failed to resolve default period: %v", err)
+		}
+	}
+
+	if err := sealMonth(ctx, db, kinesisClient, targetPeriod, *dryRun); err != nil {
+		log.Fatalf("failed to seal month %s: %v", targetPeriod, err)
+	}
+}
+
+// previousPeriodは、JSTの「今月」の前月をYYYY-MM形式で返す。月末23:59 JSTに
+// このバッチが起動される運用を想定しており、その時点での前月が締め対象となる
+func previousPeriod() (string, error) {
+	loc, err := time.LoadLocation(jst)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().In(loc)
+	firstOfThisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+	lastMonth := firstOfThisMonth.AddDate(0, -1, 0)
+	return lastMonth.Format("2006-01"), nil
+}
+
+// sealMonthは指定された期間(YYYY-MM)に属する月まとめ払いの支払約束をユーザーごとに
+// 集計し、MonthlyBillSealedEventを発行する。既にその期間を締め済みのユーザーは
+// monthly_billsのUNIQUE(user_id, period)制約によりconsumer側で無視されるため、
+// このバッチ自体は再実行しても安全（at-least-once発行を許容する設計）
+func sealMonth(ctx context.Context, db *sql.DB, kinesisClient *kinesis.Client, period string, dryRun bool) error {
+	loc, err := time.LoadLocation(jst)
+	if err != nil {
+		return err
+	}
+	periodStart, err := time.ParseInLocation("2006-01", period, loc)
+	if err != nil {
+		return err
+	}
+	periodEnd := periodStart.AddDate(0, 1, 0)
+
+	promisesByUser, err := unsealedPromisesByUser(db, periodStart, periodEnd)
+	if err != nil {
+		return err
+	}
+
+	if len(promisesByUser) == 0 {
+		log.Printf("No unsealed 月まとめ払い promises found for period %s", period)
+		return nil
+	}
+
+	for userID, promises := range promisesByUser {
+		total := 0
+		promiseIDs := make([]string, 0, len(promises))
+		for _, p := range promises {
+			total += p.amount
+			promiseIDs = append(promiseIDs, p.id)
+		}
+
+		if dryRun {
+			log.Printf("[dry-run] would seal %d promises (total %d) for user %s, period %s", len(promiseIDs), total, userID, period)
+			continue
+		}
+
+		sealedEvent := events.MonthlyBillSealedEvent{
+			EventType:     "MonthlyBillSealedEvent",
+			EventUUID:     uuid.New().String(),
+			SchemaVersion: events.CurrentSchemaVersion,
+			UserID:        userID,
+			Period:        period,
+			PromiseIDs:    promiseIDs,
+			TotalAmount:   total,
+		}
+		if err := producer.EmitEvent(ctx, kinesisClient, sealedEvent, sealedEvent.UserID); err != nil {
+			log.Printf("Failed to emit monthly bill sealed event for user %s: %v", userID, err)
+		}
+	}
+
+	return nil
+}
+
+type sealablePromise struct {
+	id     string
+	amount int
+}
+
+// unsealedPromisesByUserは、指定期間内に作成され、まだ月次締めに含まれていない
+// 月まとめ払いの支払約束をユーザーIDごとにグループ化して返す
+func unsealedPromisesByUser(db *sql.DB, periodStart, periodEnd time.Time) (map[string][]sealablePromise, error) {
+	rows, err := db.Query(
+		"SELECT id, user_id, amount FROM payment_promises "+
+			"WHERE payment_mode = ? AND created_at >= ? AND created_at < ? AND sealed_at IS NULL",
+		"月まとめ払い", periodStart, periodEnd,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string][]sealablePromise)
+	for rows.Next() {
+		var id, userID string
+		var amount int
+		if err := rows.Scan(&id, &userID, &amount); err != nil {
+			return nil, err
+		}
+		result[userID] = append(result[userID], sealablePromise{id: id, amount: amount})
+	}
+	return result, rows.Err()
+}